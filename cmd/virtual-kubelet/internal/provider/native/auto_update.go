@@ -0,0 +1,183 @@
+package native
+
+import (
+	"context"
+	"fmt"
+	"github.com/kok-stack/native-kubelet/log"
+	"github.com/kok-stack/native-kubelet/trace"
+	"github.com/opencontainers/go-digest"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"time"
+)
+
+const (
+	// autoUpdateAnnotation opts a pod into the auto-update controller.
+	// "registry" re-resolves each container image's manifest digest on the
+	// configured interval; "local" is reserved for images that are never
+	// re-pulled from a registry and is currently a no-op.
+	autoUpdateAnnotation = "native-kubelet.io/auto-update"
+
+	autoUpdateCooldown    = 5 * time.Minute
+	autoUpdateReadyWindow = 30 * time.Second
+)
+
+// runAutoUpdateLoop periodically checks pods opted into auto-update for a
+// new upstream image digest and rolls their containers over, modeled after
+// `podman auto-update`.
+func (p *Provider) runAutoUpdateLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(p.config.AutoUpdateInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.autoUpdatePods(ctx); err != nil {
+				log.G(ctx).Warnf("自动更新pod出现错误:", err)
+			}
+		}
+	}
+}
+
+func (p *Provider) autoUpdatePods(ctx context.Context) error {
+	ctx, span := trace.StartSpan(ctx, "Provider.autoUpdatePods")
+	defer span.End()
+
+	pods, err := p.downPodLister.List(labels.Everything())
+	if err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Annotations[autoUpdateAnnotation] != "registry" {
+			continue
+		}
+		p.autoUpdatePod(ctx, pod)
+	}
+	return nil
+}
+
+func (p *Provider) autoUpdatePod(ctx context.Context, pod *v1.Pod) {
+	ctx, span := trace.StartSpan(ctx, "Provider.autoUpdatePod")
+	defer span.End()
+	ctx = addAttributes(ctx, span, namespaceKey, pod.Namespace, nameKey, pod.Name)
+
+	key := pod.Namespace + "/" + pod.Name
+	if last, ok := p.lastAutoUpdate.Load(key); ok {
+		if time.Since(last.(time.Time)) < autoUpdateCooldown {
+			return
+		}
+	}
+
+	updated := false
+	for _, c := range pod.Spec.Containers {
+		changed, err := p.autoUpdateContainer(ctx, pod, c)
+		if err != nil {
+			span.Logger().Error("自动更新容器错误", err.Error())
+			p.emitAutoUpdateEvent(ctx, pod, v1.EventTypeWarning, fmt.Sprintf("auto-update of container %s failed: %v", c.Name, err))
+			continue
+		}
+		updated = updated || changed
+	}
+	if updated {
+		p.lastAutoUpdate.Store(key, time.Now())
+	}
+}
+
+// autoUpdateContainer re-resolves c.Image's manifest digest; if it changed
+// it pulls the new image, restarts the container via processManager, and
+// waits for the pod to report ready. A failed readiness window rolls the
+// image reference back to its previous digest and restarts again.
+func (p *Provider) autoUpdateContainer(ctx context.Context, pod *v1.Pod, c v1.Container) (bool, error) {
+	opts, err := p.resolveImagePullAuth(ctx, pod, c.Image)
+	if err != nil {
+		return false, err
+	}
+	newDigest, err := p.imageManager.ResolveDigest(ctx, c.Image, *opts)
+	if err != nil {
+		return false, err
+	}
+	oldDigest, _ := p.imageManager.CurrentDigest(c.Image)
+	if oldDigest != "" && oldDigest == newDigest {
+		return false, nil
+	}
+
+	//ref一旦repoint到newDigest,oldDigest在refsByManifest里就不再被任何引用覆盖,
+	//但rollbackContainer在就绪窗口内仍可能需要把ref再指回去,因此必须pin住
+	//oldDigest,防止恰好在这个窗口内跑的Prune把它的blob删掉
+	p.imageManager.pinDigest(oldDigest)
+	defer p.imageManager.unpinDigest(oldDigest)
+
+	if err := p.imageManager.PullImage(ctx, *opts); err != nil {
+		return false, err
+	}
+	if err := p.processManager.restart(ctx, pod); err != nil {
+		return false, err
+	}
+
+	if !p.waitPodReady(ctx, pod, autoUpdateReadyWindow) {
+		rollbackErr := p.rollbackContainer(ctx, pod, c.Image, oldDigest)
+		err := fmt.Errorf("container %s未在%s内就绪,已回滚到%s: %v", c.Name, autoUpdateReadyWindow, oldDigest, rollbackErr)
+		p.emitAutoUpdateEvent(ctx, pod, v1.EventTypeWarning, err.Error())
+		return false, err
+	}
+
+	p.emitAutoUpdateEvent(ctx, pod, v1.EventTypeNormal, fmt.Sprintf("container %s auto-updated from %s to %s", c.Name, oldDigest, newDigest))
+	return true, nil
+}
+
+func (p *Provider) rollbackContainer(ctx context.Context, pod *v1.Pod, image string, oldDigest digest.Digest) error {
+	if oldDigest == "" {
+		return fmt.Errorf("no previous digest recorded for %s", image)
+	}
+	if err := p.imageManager.SetRef(image, oldDigest); err != nil {
+		return err
+	}
+	return p.processManager.restart(ctx, pod)
+}
+
+// waitPodReady polls GetPodStatus until the pod reports Ready or window
+// elapses.
+func (p *Provider) waitPodReady(ctx context.Context, pod *v1.Pod, window time.Duration) bool {
+	deadline := time.Now().Add(window)
+	for time.Now().Before(deadline) {
+		status, err := p.GetPodStatus(ctx, pod.Namespace, pod.Name)
+		if err == nil {
+			for _, cond := range status.Conditions {
+				if cond.Type == v1.PodReady && cond.Status == v1.ConditionTrue {
+					return true
+				}
+			}
+		}
+		time.Sleep(time.Second)
+	}
+	return false
+}
+
+// emitAutoUpdateEvent records the outcome of an auto-update attempt as a
+// Kubernetes Event on the pod, so operators can see rollovers and rollbacks
+// with `kubectl describe pod` instead of only in the provider's own logs.
+func (p *Provider) emitAutoUpdateEvent(ctx context.Context, pod *v1.Pod, eventType string, message string) {
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "native-kubelet-auto-update-",
+			Namespace:    pod.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:      "Pod",
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			UID:       pod.UID,
+		},
+		Reason:         "AutoUpdate",
+		Message:        message,
+		Type:           eventType,
+		FirstTimestamp: metav1.Now(),
+		LastTimestamp:  metav1.Now(),
+	}
+	if _, err := p.downClientSet.CoreV1().Events(pod.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		log.G(ctx).Warnf("发送自动更新事件失败:", err)
+	}
+}
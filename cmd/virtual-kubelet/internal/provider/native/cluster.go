@@ -2,8 +2,10 @@ package native
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"github.com/containers/image/v5/types"
 	"github.com/kok-stack/native-kubelet/cmd/virtual-kubelet/internal/provider"
 	"github.com/kok-stack/native-kubelet/log"
 	"github.com/kok-stack/native-kubelet/node/api"
@@ -23,11 +25,15 @@ import (
 	"k8s.io/client-go/kubernetes/scheme"
 	corev1listers "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/remotecommand"
 	"k8s.io/metrics/pkg/client/clientset/versioned"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -38,11 +44,36 @@ const (
 	nodeNameKey      = "nodeName"
 	DbPath           = "data"
 	ImagePath        = "images"
+
+	// requireSignatureAnnotation, when set to "true" on a pod, makes
+	// CreatePod fail unless every container image passes the configured
+	// TrustPolicy.
+	requireSignatureAnnotation = "native-kubelet.io/require-signature"
 )
 
 type config struct {
 	WorkDir    string `json:"work_dir"`
 	MaxTimeout int    `json:"max_timeout"`
+	// TrustPolicy指向containers/image格式的policy.json,用于校验拉取镜像的签名。
+	// 为空时退化为DefaultPolicy(信任所有镜像)。
+	TrustPolicy string `json:"trust_policy"`
+	// InsecureRegistries lists registry hosts (e.g. "registry.local:5000")
+	// that should be pulled from over plain HTTP / without TLS verification.
+	InsecureRegistries []string `json:"insecure_registries"`
+	// PruneInterval, in seconds, controls how often images are garbage
+	// collected. Zero disables the automatic prune loop.
+	PruneInterval int `json:"prune_interval"`
+	// PruneKeepBytes caps the on-disk size of the image store; the prune
+	// loop evicts least-recently-used images until usage is at or below it.
+	PruneKeepBytes int64 `json:"prune_keep_bytes"`
+	// AutoUpdateInterval, in seconds, controls how often pods opted into
+	// native-kubelet.io/auto-update are checked for a new upstream image
+	// digest. Zero disables the auto-update loop.
+	AutoUpdateInterval int `json:"auto_update_interval"`
+	// DebugAddr, when non-empty, serves the provider's HTTP debug endpoints
+	// (currently just HandlePruneImages on /debug/pruneImages) on this
+	// address. Empty disables the debug server.
+	DebugAddr string `json:"debug_addr"`
 }
 
 type Provider struct {
@@ -55,6 +86,8 @@ type Provider struct {
 	imageManager   *ImageManager
 	db             *bitcask.Bitcask
 	processManager *ProcessManager
+	secretLister   corev1listers.SecretLister
+	lastAutoUpdate sync.Map
 }
 
 func (p *Provider) NotifyPods(ctx context.Context, f func(*v1.Pod)) {
@@ -93,6 +126,23 @@ func (p *Provider) CreatePod(ctx context.Context, pod *v1.Pod) error {
 		return err2
 	}
 
+	if err := p.verifyPullPolicy(ctx, pod); err != nil {
+		span.SetStatus(err)
+		return err
+	}
+
+	for _, c := range pod.Spec.Containers {
+		opts, err := p.resolveImagePullAuth(ctx, pod, c.Image)
+		if err != nil {
+			span.SetStatus(err)
+			return err
+		}
+		if err := p.imageManager.PullImage(ctx, *opts); err != nil {
+			span.SetStatus(err)
+			return err
+		}
+	}
+
 	//trimPod(pod, p.initConfig.NodeName)
 	//TODO:放到本地存储中
 	p.processManager.create(ctx, pod)
@@ -105,6 +155,182 @@ func (p *Provider) CreatePod(ctx context.Context, pod *v1.Pod) error {
 	return err
 }
 
+// verifyPullPolicy checks the native-kubelet.io/require-signature annotation
+// and, when set to "true", rejects the pod unless every container image
+// passes the provider's configured trust policy. This surfaces signature
+// enforcement failures to Kubernetes users as a CreatePod error instead of
+// only failing deep inside the pull path.
+func (p *Provider) verifyPullPolicy(ctx context.Context, pod *v1.Pod) error {
+	ctx, span := trace.StartSpan(ctx, "Provider.verifyPullPolicy")
+	defer span.End()
+
+	if pod.Annotations[requireSignatureAnnotation] != "true" {
+		return nil
+	}
+	for _, c := range pod.Spec.Containers {
+		opts, err := p.resolveImagePullAuth(ctx, pod, c.Image)
+		if err != nil {
+			span.SetStatus(err)
+			return err
+		}
+		if err := p.imageManager.VerifyImagePolicy(ctx, c.Image, *opts); err != nil {
+			err = errors.Wrapf(err, "pod %s/%s要求签名校验,但镜像%s未通过trust policy", pod.Namespace, pod.Name, c.Image)
+			span.SetStatus(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveImagePullAuth翻译pod.Spec.ImagePullSecrets为containers/image能直接使用的
+// PullImageOpts:依次查找每个引用的Secret(dockerconfigjson/dockercfg),用镜像的
+// registry host去匹配auths中的key(支持*.example.com通配和registry/project子路径),
+// 命中后即返回对应的DockerAuthConfig。同时按native.config里的InsecureRegistries
+// 决定是否跳过TLS校验。
+func (p *Provider) resolveImagePullAuth(ctx context.Context, pod *v1.Pod, containerImage string) (*PullImageOpts, error) {
+	ctx, span := trace.StartSpan(ctx, "Provider.resolveImagePullAuth")
+	defer span.End()
+
+	host := registryHostFromRef(containerImage)
+	opts := &PullImageOpts{SrcImage: containerImage}
+	if isInsecureRegistry(p.config.InsecureRegistries, host) {
+		opts.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		secret, err := p.secretLister.Secrets(pod.Namespace).Get(ref.Name)
+		if err != nil {
+			if errors2.IsNotFound(err) {
+				continue
+			}
+			span.SetStatus(err)
+			return nil, err
+		}
+		auth, ok, err := dockerAuthForHost(secret, host)
+		if err != nil {
+			span.SetStatus(err)
+			return nil, err
+		}
+		if ok {
+			opts.DockerAuthConfig = auth
+			return opts, nil
+		}
+	}
+	return opts, nil
+}
+
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+func dockerAuthForHost(secret *v1.Secret, host string) (*types.DockerAuthConfig, bool, error) {
+	switch secret.Type {
+	case v1.SecretTypeDockerConfigJson:
+		cfg := &dockerConfigJSON{}
+		if err := json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], cfg); err != nil {
+			return nil, false, err
+		}
+		return lookupDockerAuth(cfg.Auths, host)
+	case v1.SecretTypeDockercfg:
+		auths := map[string]dockerConfigEntry{}
+		if err := json.Unmarshal(secret.Data[v1.DockerConfigKey], &auths); err != nil {
+			return nil, false, err
+		}
+		return lookupDockerAuth(auths, host)
+	default:
+		return nil, false, nil
+	}
+}
+
+func lookupDockerAuth(auths map[string]dockerConfigEntry, host string) (*types.DockerAuthConfig, bool, error) {
+	best := ""
+	for registry := range auths {
+		if matchRegistryHost(registry, host) && len(registry) > len(best) {
+			best = registry
+		}
+	}
+	if best == "" {
+		return nil, false, nil
+	}
+	entry := auths[best]
+	username, password := entry.Username, entry.Password
+	if username == "" && password == "" && entry.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, false, err
+		}
+		if parts := strings.SplitN(string(decoded), ":", 2); len(parts) == 2 {
+			username, password = parts[0], parts[1]
+		}
+	}
+	return &types.DockerAuthConfig{Username: username, Password: password}, true, nil
+}
+
+// matchRegistryHost reports whether a dockerconfigjson registry key - a bare
+// host, a host/project path, or a "*.example.com" wildcard - matches the
+// host[/path] an image reference resolves to.
+func matchRegistryHost(pattern string, host string) bool {
+	pattern = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(pattern, "https://"), "http://"), "/")
+
+	patternHost, patternPath := pattern, ""
+	if idx := strings.Index(pattern, "/"); idx != -1 {
+		patternHost, patternPath = pattern[:idx], pattern[idx:]
+	}
+	hostOnly := host
+	if idx := strings.Index(host, "/"); idx != -1 {
+		hostOnly = host[:idx]
+	}
+
+	if strings.HasPrefix(patternHost, "*.") {
+		if !strings.HasSuffix(hostOnly, patternHost[1:]) {
+			return false
+		}
+	} else if hostOnly != patternHost {
+		return false
+	}
+	if patternPath != "" {
+		hostPath := strings.TrimPrefix(host, hostOnly)
+		return hostPath == patternPath || strings.HasPrefix(hostPath, patternPath+"/")
+	}
+	return true
+}
+
+func isInsecureRegistry(insecure []string, host string) bool {
+	hostOnly := host
+	if idx := strings.Index(host, "/"); idx != -1 {
+		hostOnly = host[:idx]
+	}
+	for _, h := range insecure {
+		if h == hostOnly {
+			return true
+		}
+	}
+	return false
+}
+
+// registryHostFromRef extracts the registry host and repository path
+// (without tag or digest) from an image reference, e.g.
+// "docker://registry.example.com/project/image:v1" becomes
+// "registry.example.com/project/image".
+func registryHostFromRef(imageRef string) string {
+	ref := imageRef
+	if idx := strings.Index(ref, "://"); idx != -1 {
+		ref = ref[idx+3:]
+	}
+	if at := strings.Index(ref, "@"); at != -1 {
+		ref = ref[:at]
+	} else if idx := strings.LastIndex(ref, ":"); idx != -1 && idx > strings.LastIndex(ref, "/") {
+		ref = ref[:idx]
+	}
+	return ref
+}
+
 func (p *Provider) UpdatePod(ctx context.Context, pod *v1.Pod) error {
 	//up-->down
 	ctx, span := trace.StartSpan(ctx, "Provider.UpdatePod")
@@ -316,11 +542,102 @@ func (p *Provider) start(ctx context.Context) error {
 		}
 	}()
 	p.db = db
-	p.imageManager = NewImageManager(filepath.Join(p.config.WorkDir, ImagePath), db)
+	p.imageManager = NewImageManager(filepath.Join(p.config.WorkDir, ImagePath), db, p.config.MaxTimeout, p.config.TrustPolicy)
 	p.processManager = newProcessManager(p.imageManager)
+
+	secretInformerFactory := informers.NewSharedInformerFactory(p.downClientSet, 30*time.Second)
+	secretInformer := secretInformerFactory.Core().V1().Secrets()
+	p.secretLister = secretInformer.Lister()
+	secretInformerFactory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), secretInformer.Informer().HasSynced) {
+		return fmt.Errorf("等待secret informer缓存同步失败")
+	}
+
+	if p.config.PruneInterval > 0 {
+		go p.runPruneLoop(ctx)
+	}
+	if p.config.AutoUpdateInterval > 0 {
+		go p.runAutoUpdateLoop(ctx)
+	}
+	if p.config.DebugAddr != "" {
+		go p.runDebugServer(ctx)
+	}
 	return nil
 }
 
+// runDebugServer serves HandlePruneImages (and any future debug endpoint)
+// on native.config's DebugAddr, stopping when ctx is done. Without this,
+// HandlePruneImages is unreachable from any HTTP client.
+func (p *Provider) runDebugServer(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pruneImages", p.HandlePruneImages)
+	srv := &http.Server{Addr: p.config.DebugAddr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.G(ctx).Warnf("debug server退出", err)
+	}
+}
+
+// runPruneLoop periodically calls Prune on a PruneInterval/PruneKeepBytes
+// ticker configured in native.config, stopping when ctx is done.
+func (p *Provider) runPruneLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(p.config.PruneInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := p.pruneImages(ctx, PruneOptions{KeepBytes: p.config.PruneKeepBytes}); err != nil {
+				log.G(ctx).Warnf("定时清理镜像出现错误:", err)
+			}
+		}
+	}
+}
+
+// pruneImages runs ImageManager.Prune, protecting every image still
+// referenced by a pod the down cluster currently knows about.
+func (p *Provider) pruneImages(ctx context.Context, opts PruneOptions) (*PruneResult, error) {
+	ctx, span := trace.StartSpan(ctx, "Provider.pruneImages")
+	defer span.End()
+
+	pods, err := p.downPodLister.List(labels.Everything())
+	if err != nil {
+		span.SetStatus(err)
+		return nil, err
+	}
+	inUse := make(map[string]bool)
+	for _, pod := range pods {
+		for _, c := range pod.Spec.Containers {
+			inUse[c.Image] = true
+		}
+	}
+	result, err := p.imageManager.Prune(ctx, opts, inUse)
+	if err != nil {
+		span.SetStatus(err)
+		return nil, err
+	}
+	span.Logger().Debug("清理镜像完成", result)
+	return result, nil
+}
+
+// HandlePruneImages is an HTTP debug endpoint, served by runDebugServer on
+// native.config's DebugAddr, that lets operators trigger an on-demand image
+// prune and see how many bytes were reclaimed.
+func (p *Provider) HandlePruneImages(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	result, err := p.pruneImages(ctx, PruneOptions{KeepBytes: p.config.PruneKeepBytes})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
 func NewProvider(ctx context.Context, cfg provider.InitConfig) (*Provider, error) {
 	p := &Provider{
 		initConfig: cfg,
@@ -0,0 +1,90 @@
+package native
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestMatchRegistryHost(t *testing.T) {
+	cases := []struct {
+		name    string
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"bare host match", "ccr.ccs.tencentyun.com", "ccr.ccs.tencentyun.com", true},
+		{"bare host mismatch", "ccr.ccs.tencentyun.com", "docker.io", false},
+		{"wildcard match", "*.tencentyun.com", "ccr.ccs.tencentyun.com", true},
+		{"wildcard mismatch", "*.tencentyun.com", "ccr.ccs.example.com", false},
+		{"scheme and trailing slash stripped from pattern", "https://ccr.ccs.tencentyun.com/", "ccr.ccs.tencentyun.com", true},
+		{"project path exact match", "ccr.ccs.tencentyun.com/k8s-test", "ccr.ccs.tencentyun.com/k8s-test", true},
+		{"project path subpath match", "ccr.ccs.tencentyun.com/k8s-test", "ccr.ccs.tencentyun.com/k8s-test/test", true},
+		{"project path does not match a sibling path", "ccr.ccs.tencentyun.com/k8s-test", "ccr.ccs.tencentyun.com/k8s-test2", false},
+		{"project path does not match a sibling path with deeper suffix", "ccr.ccs.tencentyun.com/k8s-test", "ccr.ccs.tencentyun.com/k8s-test2/test", false},
+		{"host without path never matches a pattern with a path", "ccr.ccs.tencentyun.com/k8s-test", "ccr.ccs.tencentyun.com", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := matchRegistryHost(c.pattern, c.host); got != c.want {
+				t.Errorf("matchRegistryHost(%q, %q) = %v, want %v", c.pattern, c.host, got, c.want)
+			}
+		})
+	}
+}
+
+func TestLookupDockerAuth(t *testing.T) {
+	t.Run("prefers the longest matching registry key", func(t *testing.T) {
+		auths := map[string]dockerConfigEntry{
+			"*.tencentyun.com":               {Username: "wildcard", Password: "x"},
+			"ccr.ccs.tencentyun.com/k8s-test": {Username: "scoped", Password: "y"},
+		}
+		auth, ok, err := lookupDockerAuth(auths, "ccr.ccs.tencentyun.com/k8s-test/test")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok || auth.Username != "scoped" {
+			t.Fatalf("expected the scoped entry to win, got ok=%v auth=%+v", ok, auth)
+		}
+	})
+
+	t.Run("falls back to decoding the base64 auth field", func(t *testing.T) {
+		encoded := base64.StdEncoding.EncodeToString([]byte("alice:secret"))
+		auths := map[string]dockerConfigEntry{
+			"ccr.ccs.tencentyun.com": {Auth: encoded},
+		}
+		auth, ok, err := lookupDockerAuth(auths, "ccr.ccs.tencentyun.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok || auth.Username != "alice" || auth.Password != "secret" {
+			t.Fatalf("expected username/password decoded from auth, got ok=%v auth=%+v", ok, auth)
+		}
+	})
+
+	t.Run("username/password take precedence over auth", func(t *testing.T) {
+		encoded := base64.StdEncoding.EncodeToString([]byte("ignored:ignored"))
+		auths := map[string]dockerConfigEntry{
+			"ccr.ccs.tencentyun.com": {Username: "alice", Password: "secret", Auth: encoded},
+		}
+		auth, ok, err := lookupDockerAuth(auths, "ccr.ccs.tencentyun.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok || auth.Username != "alice" || auth.Password != "secret" {
+			t.Fatalf("expected explicit username/password to win, got ok=%v auth=%+v", ok, auth)
+		}
+	})
+
+	t.Run("no matching registry", func(t *testing.T) {
+		auths := map[string]dockerConfigEntry{
+			"docker.io": {Username: "alice", Password: "secret"},
+		}
+		_, ok, err := lookupDockerAuth(auths, "ccr.ccs.tencentyun.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ok {
+			t.Fatalf("expected no match")
+		}
+	})
+}
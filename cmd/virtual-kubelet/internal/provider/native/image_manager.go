@@ -1,22 +1,24 @@
 package native
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/containerd/containerd/images"
 	cc "github.com/containers/image/v5/copy"
-	"github.com/containers/image/v5/directory"
-	"github.com/containers/image/v5/docker/archive"
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/oci/layout"
 	"github.com/containers/image/v5/signature"
-	"github.com/containers/image/v5/transports"
 	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
-	"github.com/flytam/filenamify"
+	"github.com/klauspost/compress/zstd"
 	"github.com/kok-stack/native-kubelet/trace"
 	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/prologic/bitcask"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -24,11 +26,20 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const pullLogPrefix = "native-kubelet-pullImage-"
-const manifestFileName = "manifest.json"
+
+// bitcask key prefixes for the image index. A "ref" entry maps a user
+// supplied image reference to the manifest digest it last resolved to, and
+// a "manifest" entry maps that digest to the ImageIndexEntry describing its
+// layers and how many refs still point at it.
+const (
+	refKeyPrefix      = "ref:"
+	manifestKeyPrefix = "manifest:"
+)
 
 type ImagePulling struct {
 	imageName string
@@ -43,21 +54,75 @@ func NewImagePulling(imageName string) *ImagePulling {
 	}
 }
 
+// ImageIndexEntry is the typed schema stored in the bitcask index for a
+// pulled manifest: its ordered layer digests. It replaces the previous
+// scheme of storing a raw on-disk tar.gz path per image reference. Which
+// manifests are still referenced is derived on demand from the "ref:" keys
+// (see refsByManifest), not tracked as a counter here.
+type ImageIndexEntry struct {
+	ManifestDigest digest.Digest   `json:"manifest_digest"`
+	Layers         []digest.Digest `json:"layers"`
+	// LastUsed is refreshed every time MaterializeRootfs resolves this
+	// manifest, so Prune can evict on an LRU basis.
+	LastUsed time.Time `json:"last_used"`
+}
+
 type ImageManager struct {
-	imagePath string
-	pulling   sync.Map
-	imageDb   *bitcask.Bitcask
-	max       int
+	imagePath       string
+	pulling         sync.Map
+	imageDb         *bitcask.Bitcask
+	max             int
+	trustPolicyPath string
+	// pinned holds a *int32 refcount per manifest digest that Prune must
+	// not remove even though refsByManifest doesn't (yet, or any longer)
+	// show it in use - e.g. auto_update.go's rollback window, where ref:
+	// already points at the new digest but rollbackContainer may still
+	// need to SetRef back to the old one.
+	pinned sync.Map
 }
 
-func NewImageManager(imagePath string, db *bitcask.Bitcask, max int) *ImageManager {
+func NewImageManager(imagePath string, db *bitcask.Bitcask, max int, trustPolicyPath string) *ImageManager {
 	return &ImageManager{
-		imagePath: imagePath,
-		imageDb:   db,
-		max:       max,
+		imagePath:       imagePath,
+		imageDb:         db,
+		max:             max,
+		trustPolicyPath: trustPolicyPath,
 	}
 }
 
+// pinDigest marks d as ineligible for Prune until a matching unpinDigest
+// call releases it. Calls nest: d stays pinned until every pin is released.
+func (m *ImageManager) pinDigest(d digest.Digest) {
+	if d == "" {
+		return
+	}
+	actual, _ := m.pinned.LoadOrStore(d, new(int32))
+	atomic.AddInt32(actual.(*int32), 1)
+}
+
+// unpinDigest releases one pinDigest hold on d.
+func (m *ImageManager) unpinDigest(d digest.Digest) {
+	if d == "" {
+		return
+	}
+	v, ok := m.pinned.Load(d)
+	if !ok {
+		return
+	}
+	if atomic.AddInt32(v.(*int32), -1) <= 0 {
+		m.pinned.Delete(d)
+	}
+}
+
+// isPinned reports whether d currently has an outstanding pinDigest hold.
+func (m *ImageManager) isPinned(d digest.Digest) bool {
+	v, ok := m.pinned.Load(d)
+	if !ok {
+		return false
+	}
+	return atomic.LoadInt32(v.(*int32)) > 0
+}
+
 type PullImageOpts struct {
 	SrcImage string // docker://ccr.ccs.tencentyun.com/k8s-test/test:oci-test-v1
 
@@ -66,11 +131,42 @@ type PullImageOpts struct {
 	DockerRegistryUserAgent     string
 	DockerInsecureSkipTLSVerify types.OptionalBool
 
+	// RegistriesDirPath and SignaturePolicyPath override the provider-wide
+	// registries.d directory / policy.json for this pull only.
+	RegistriesDirPath   string
+	SignaturePolicyPath string
+
 	Timeout    time.Duration
 	RetryCount int
 	//Stdout     io.Writer
 }
 
+// buildPolicyContext加载trust policy(containers/image的policy.json格式)并构造出
+// 用于校验签名的PolicyContext。overridePath非空时优先于defaultPath,未配置任何
+// policy文件时回退到DefaultPolicy(即信任所有镜像)。
+func buildPolicyContext(defaultPath string, overridePath string) (*signature.PolicyContext, error) {
+	path := defaultPath
+	if overridePath != "" {
+		path = overridePath
+	}
+	var policy *signature.Policy
+	var err error
+	if path != "" {
+		policy, err = signature.NewPolicyFromFile(path)
+	} else {
+		policy, err = signature.DefaultPolicy(nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return signature.NewPolicyContext(policy)
+}
+
+// PullImage拉取镜像到本地的content-addressed存储中(blobs/sha256/<digest>)。
+// 以manifest digest判断幂等:只要digest对应的manifest已经在共享store中,就只
+// 做一次不下载layer的HEAD式manifest解析加trust policy校验来更新ref,不会重新
+// 拉取或覆盖共享的layer blob,也不会为此付出一次完整的网络拷贝——但每次仍然
+// 按当前policy重新校验,不会因为共享store命中而绕过签名校验。
 func (m *ImageManager) PullImage(ctx context.Context, opts PullImageOpts) error {
 	ctx, span := trace.StartSpan(ctx, "ImageManager.PullImage")
 	defer span.End()
@@ -80,17 +176,8 @@ func (m *ImageManager) PullImage(ctx context.Context, opts PullImageOpts) error
 		span.SetStatus(err)
 		return err
 	}
-	dest, imageDir, err := imageDestDir(m.imagePath, opts.SrcImage)
-	if err != nil {
-		span.SetStatus(err)
-		return err
-	}
-	//检查文件夹是否存在,不存在则创建
-	if err := createDestDir(filepath.Dir(imageDir)); err != nil {
-		return err
-	}
-	destRef, err := alltransports.ParseImageName(dest)
-	if err != nil {
+
+	if err := createDestDir(m.blobsDir()); err != nil {
 		span.SetStatus(err)
 		return err
 	}
@@ -100,33 +187,41 @@ func (m *ImageManager) PullImage(ctx context.Context, opts PullImageOpts) error
 		DockerBearerRegistryToken:   opts.DockerBearerRegistryToken,
 		DockerRegistryUserAgent:     opts.DockerRegistryUserAgent,
 		DockerInsecureSkipTLSVerify: opts.DockerInsecureSkipTLSVerify,
+		RegistriesDirPath:           opts.RegistriesDirPath,
 	}
 	destinationCtx := &types.SystemContext{}
 
-	policy, err := signature.DefaultPolicy(nil)
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Duration(m.max) * time.Second
+	}
+	subCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	policyContext, err := buildPolicyContext(m.trustPolicyPath, opts.SignaturePolicyPath)
 	if err != nil {
 		span.SetStatus(err)
 		return err
 	}
-	policyContext, err := signature.NewPolicyContext(policy)
+	defer policyContext.Destroy()
+
+	manifestDigest, err := m.verifyAndResolveDigest(subCtx, name, srcRef, sourceCtx, policyContext)
 	if err != nil {
 		span.SetStatus(err)
 		return err
 	}
-	if opts.Timeout == 0 {
-		opts.Timeout = time.Duration(m.max) * time.Second
+	//从resolve到putRef落盘之前,manifestDigest可能还没有任何ref指向它(或指向它的
+	//ref恰好是Prune候选),pin住它防止一次并发的Prune在putRef之前把它清理掉
+	m.pinDigest(manifestDigest)
+	defer m.unpinDigest(manifestDigest)
+
+	if _, err := m.getManifestEntry(manifestDigest); err == nil {
+		//manifest已经在共享store中且刚通过了当前policy的校验,layer必然也都已
+		//落盘,不需要再走一遍网络拷贝
+		return m.putRef(name, manifestDigest)
 	}
-	subCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
-	defer cancel()
 
 check:
-	//检查是否存在镜像
-	ok := m.imageDb.Has([]byte(name))
-	if ok {
-		span.Logger().Debug("检查到镜像存在,直接返回")
-		return nil
-	}
-	//如果不存在,检查是否正在pull
+	//检查是否正在pull
 	v, ok := m.pulling.Load(name)
 	if ok {
 		//正在pull,则等到pull结束
@@ -134,10 +229,13 @@ check:
 		pull := v.(*ImagePulling)
 		<-pull.ch
 		span.Logger().Debug("镜像pull结束")
+		if _, err := m.getManifestEntry(manifestDigest); err == nil {
+			//等待的那次pull已经把相同digest的manifest落盘,直接复用,避免紧接着
+			//再做一次完整的网络拷贝
+			return m.putRef(name, manifestDigest)
+		}
 		goto check
 	}
-	//没有在pull,则执行pull
-	span.Logger().Debug("镜像未pull,开始执行pull")
 
 	pulling := NewImagePulling(name)
 	m.pulling.LoadOrStore(name, pulling)
@@ -145,8 +243,6 @@ check:
 	defer m.pulling.Delete(name)
 	logName := strconv.Itoa(rand.Intn(time.Now().Nanosecond()))
 
-	err = deleteExistImage(imageDir)
-
 	pulling.f, err = os.OpenFile(filepath.Join(os.TempDir(), fmt.Sprintf("%s-%s", pullLogPrefix, logName)), os.O_CREATE|os.O_RDWR, 0755)
 	if err != nil {
 		span.SetStatus(err)
@@ -154,7 +250,20 @@ check:
 	}
 	defer pulling.f.Close()
 
-	_, err = cc.Image(subCtx, policyContext, destRef, srcRef, &cc.Options{
+	stageDir, err := ioutil.TempDir(m.stagingDir(), "pull-")
+	if err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+
+	destRef, err := layout.NewReference(stageDir, "")
+	if err != nil {
+		span.SetStatus(err)
+		return err
+	}
+
+	manifestBytes, err := cc.Image(subCtx, policyContext, destRef, srcRef, &cc.Options{
 		ReportWriter:       pulling.f,
 		SourceCtx:          sourceCtx,
 		DestinationCtx:     destinationCtx,
@@ -165,19 +274,152 @@ check:
 		span.SetStatus(err)
 		return err
 	}
-	return m.imageDb.Put([]byte(name), []byte(dest))
-}
 
-func deleteExistImage(dir string) error {
-	if err := os.Remove(dir); err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	manifestDigest = digest.FromBytes(manifestBytes)
+
+	manifestDoc := &v1.Manifest{}
+	if err := json.Unmarshal(manifestBytes, manifestDoc); err != nil {
+		span.SetStatus(err)
+		return err
+	}
+
+	if _, err := m.getManifestEntry(manifestDigest); err == nil {
+		//两次digest解析之间另一个pull已经落盘了相同的manifest,layer已在共享
+		//blob store中,直接复用
+		return m.putRef(name, manifestDigest)
+	}
+
+	layers := make([]digest.Digest, 0, len(manifestDoc.Layers))
+	for _, l := range manifestDoc.Layers {
+		if err := m.adoptBlob(stageDir, l.Digest); err != nil {
+			span.SetStatus(err)
+			return err
 		}
+		layers = append(layers, l.Digest)
+	}
+	if err := m.adoptBlob(stageDir, manifestDigest); err != nil {
+		span.SetStatus(err)
+		return err
+	}
+
+	if err := m.putManifestEntry(manifestDigest, &ImageIndexEntry{
+		ManifestDigest: manifestDigest,
+		Layers:         layers,
+		LastUsed:       time.Now(),
+	}); err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	return m.putRef(name, manifestDigest)
+}
+
+// verifyAndResolveDigest fetches just srcRef's manifest (a HEAD equivalent,
+// no layers downloaded), checks it against policyContext and returns its
+// digest. PullImage always calls this before consulting the shared store,
+// so a cache hit still gets a real trust-policy verdict under the
+// *current* policy instead of skipping verification because some earlier
+// pull (possibly under a looser policy) already populated the store.
+func (m *ImageManager) verifyAndResolveDigest(ctx context.Context, imageName string, srcRef types.ImageReference, sourceCtx *types.SystemContext, policyContext *signature.PolicyContext) (digest.Digest, error) {
+	src, err := srcRef.NewImageSource(ctx, sourceCtx)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	unparsed := image.UnparsedInstance(src, nil)
+	manifestBytes, _, err := unparsed.Manifest(ctx)
+	if err != nil {
+		return "", err
+	}
+	allowed, err := policyContext.IsRunningImageAllowed(ctx, unparsed)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", fmt.Errorf("image %s 未通过trust policy校验", imageName)
+	}
+	return digest.FromBytes(manifestBytes), nil
+}
+
+// resolveManifestDigest fetches just srcRef's manifest (a HEAD equivalent,
+// no layers downloaded) without any policy check, for callers like
+// ResolveDigest that only need to detect a moved tag.
+func (m *ImageManager) resolveManifestDigest(ctx context.Context, srcRef types.ImageReference, sourceCtx *types.SystemContext) (digest.Digest, error) {
+	src, err := srcRef.NewImageSource(ctx, sourceCtx)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	manifestBytes, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(manifestBytes), nil
+}
+
+// adoptBlob moves a blob copied into the staging directory into the shared
+// content-addressed store, keyed by its digest. If the blob is already
+// present (shared with another image) the staged copy is simply dropped.
+func (m *ImageManager) adoptBlob(stageDir string, d digest.Digest) error {
+	dest := m.blobPath(d)
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+	src := filepath.Join(stageDir, "blobs", d.Algorithm().String(), d.Encoded())
+	if err := os.Rename(src, dest); err != nil {
 		return err
 	}
 	return nil
 }
 
+func (m *ImageManager) blobsDir() string {
+	return filepath.Join(m.imagePath, "blobs", "sha256")
+}
+
+func (m *ImageManager) blobPath(d digest.Digest) string {
+	return filepath.Join(m.blobsDir(), d.Encoded())
+}
+
+func (m *ImageManager) stagingDir() string {
+	return filepath.Join(m.imagePath, ".staging")
+}
+
+func (m *ImageManager) layersDir() string {
+	return filepath.Join(m.imagePath, "layers")
+}
+
+func (m *ImageManager) putRef(imageName string, manifestDigest digest.Digest) error {
+	return m.imageDb.Put([]byte(refKeyPrefix+imageName), []byte(manifestDigest.String()))
+}
+
+func (m *ImageManager) getRef(imageName string) (digest.Digest, error) {
+	v, err := m.imageDb.Get([]byte(refKeyPrefix + imageName))
+	if err != nil {
+		return "", err
+	}
+	return digest.Parse(string(v))
+}
+
+func (m *ImageManager) putManifestEntry(d digest.Digest, entry *ImageIndexEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return m.imageDb.Put([]byte(manifestKeyPrefix+d.String()), b)
+}
+
+func (m *ImageManager) getManifestEntry(d digest.Digest) (*ImageIndexEntry, error) {
+	v, err := m.imageDb.Get([]byte(manifestKeyPrefix + d.String()))
+	if err != nil {
+		return nil, err
+	}
+	entry := &ImageIndexEntry{}
+	if err := json.Unmarshal(v, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
 func createDestDir(dir string) error {
 	_, err := os.Stat(dir)
 	if err == nil {
@@ -192,131 +434,406 @@ func createDestDir(dir string) error {
 	return err
 }
 
-func (m *ImageManager) UnzipImage(ctx context.Context, image string, workdir string) error {
-	ctx, span := trace.StartSpan(ctx, "ImageManager.UnzipImage")
+// MaterializeRootfs builds a pod's rootfs out of the shared,
+// content-addressed layer store: it never touches the network and never
+// gunzips a shared layer twice. Each layer is extracted once into
+// layers/<digest>, and that directory's contents are hard-linked into
+// containerWorkDir(workdir) for every pod that needs it.
+func (m *ImageManager) MaterializeRootfs(ctx context.Context, image string, workdir string) error {
+	ctx, span := trace.StartSpan(ctx, "ImageManager.MaterializeRootfs")
 	defer span.End()
-	imageDir := getImageWorkDir(workdir)
 	ctx = span.WithFields(ctx, map[string]interface{}{
-		"image":    image,
-		"workdir":  workdir,
-		"imageDir": imageDir,
+		"image":   image,
+		"workdir": workdir,
 	})
-	policy, err := signature.DefaultPolicy(nil)
+
+	manifestDigest, err := m.getRef(image)
 	if err != nil {
 		span.SetStatus(err)
 		return err
 	}
-	policyContext, err := signature.NewPolicyContext(policy)
+	entry, err := m.getManifestEntry(manifestDigest)
 	if err != nil {
 		span.SetStatus(err)
 		return err
 	}
-	//解析workdir
-	if err := createDestDir(imageDir); err != nil {
+	entry.LastUsed = time.Now()
+	if err := m.putManifestEntry(manifestDigest, entry); err != nil {
 		span.SetStatus(err)
 		return err
 	}
-	destRef, err := directory.Transport.ParseReference(imageDir)
+
+	manifestBytes, err := ioutil.ReadFile(m.blobPath(manifestDigest))
 	if err != nil {
 		span.SetStatus(err)
 		return err
 	}
-	//获取image的path
-	imagePath, err := m.imageDb.Get([]byte(dockerImageName(image)))
-	if err != nil {
+	manifestDoc := &v1.Manifest{}
+	if err := json.Unmarshal(manifestBytes, manifestDoc); err != nil {
 		span.SetStatus(err)
 		return err
 	}
-	//解析
-	srcRef, err := alltransports.ParseImageName(string(imagePath))
-	if err != nil {
+	mediaTypeByDigest := make(map[digest.Digest]string, len(manifestDoc.Layers))
+	for _, l := range manifestDoc.Layers {
+		mediaTypeByDigest[l.Digest] = l.MediaType
+	}
+
+	dest := containerWorkDir(workdir)
+	if err := createDestDir(dest); err != nil {
 		span.SetStatus(err)
 		return err
 	}
-	sourceCtx := &types.SystemContext{}
-	destinationCtx := &types.SystemContext{}
 
-	//解压镜像
-	if _, err := cc.Image(ctx, policyContext, destRef, srcRef, &cc.Options{
-		ReportWriter:       nil,
-		SourceCtx:          sourceCtx,
-		DestinationCtx:     destinationCtx,
-		ImageListSelection: cc.CopySystemImage,
-	}); err != nil {
+	for _, layerDigest := range entry.Layers {
+		layerDir, err := m.ensureLayerExtracted(ctx, layerDigest, mediaTypeByDigest[layerDigest])
+		if err != nil {
+			span.SetStatus(err)
+			return err
+		}
+		if err := linkTree(layerDir, dest); err != nil {
+			span.SetStatus(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// gzipLayerMediaTypes and friends enumerate every layer media type this
+// store knows how to unpack, covering Docker schema2, OCI and their
+// non-distributable ("foreign") counterparts.
+var (
+	gzipLayerMediaTypes = map[string]bool{
+		images.MediaTypeDockerSchema2LayerGzip:        true,
+		images.MediaTypeDockerSchema2LayerForeignGzip: true,
+		v1.MediaTypeImageLayerGzip:                    true,
+		v1.MediaTypeImageLayerNonDistributableGzip:    true,
+	}
+	zstdLayerMediaTypes = map[string]bool{
+		v1.MediaTypeImageLayerZstd:                 true,
+		v1.MediaTypeImageLayerNonDistributableZstd: true,
+	}
+	plainLayerMediaTypes = map[string]bool{
+		images.MediaTypeDockerSchema2Layer:        true,
+		images.MediaTypeDockerSchema2LayerForeign: true,
+		v1.MediaTypeImageLayer:                    true,
+		v1.MediaTypeImageLayerNonDistributable:    true,
+	}
+)
+
+// ensureLayerExtracted extracts a shared layer blob into layers/<digest> the
+// first time it is needed, and reuses that directory on every subsequent
+// call for any pod sharing the same base image. The decompressor used is
+// chosen from the layer's media type, so gzip, zstd and uncompressed OCI/
+// Docker layers (and their non-distributable variants) all land in the same
+// shared store.
+func (m *ImageManager) ensureLayerExtracted(ctx context.Context, layerDigest digest.Digest, mediaType string) (string, error) {
+	_, span := trace.StartSpan(ctx, "ImageManager.ensureLayerExtracted")
+	defer span.End()
+	layerDir := filepath.Join(m.layersDir(), layerDigest.Encoded())
+	doneMarker := filepath.Join(layerDir, ".extracted")
+	if _, err := os.Stat(doneMarker); err == nil {
+		return layerDir, nil
+	}
+	if err := createDestDir(layerDir); err != nil {
 		span.SetStatus(err)
-		return err
+		return "", err
 	}
-	span.Logger().Debug("解压tar包完成,开始解压镜像layer")
-	//解压 "层"
-	content, err := ioutil.ReadFile(manifestDir(imageDir))
-	if err != nil {
-		span.Logger().Error("解压镜像layer错误")
+
+	if !gzipLayerMediaTypes[mediaType] && !zstdLayerMediaTypes[mediaType] && !plainLayerMediaTypes[mediaType] {
+		err := fmt.Errorf("unsupport layer %s media type:%s", layerDigest.Encoded(), mediaType)
 		span.SetStatus(err)
-		return err
+		return "", err
 	}
-	manifest := &v1.Manifest{}
-	err = json.Unmarshal(content, manifest)
+
+	rc, err := openLayerBlob(m.blobPath(layerDigest), mediaType)
 	if err != nil {
-		span.Logger().Error("反序列化Manifest错误")
+		span.Logger().Error("打开层blob错误")
 		span.SetStatus(err)
-		return err
+		return "", err
+	}
+	defer rc.Close()
+
+	if err := extractTar(rc, layerDir); err != nil {
+		span.Logger().Error("用tar包解压层错误")
+		span.SetStatus(err)
+		return "", err
+	}
+	if err := ioutil.WriteFile(doneMarker, []byte{}, 0644); err != nil {
+		span.SetStatus(err)
+		return "", err
+	}
+	return layerDir, nil
+}
+
+// openLayerBlob opens a layer blob and wraps it with the decompressor
+// matching its media type (gzip, zstd, or identity for already-uncompressed
+// layers), returning a single ReadCloser that closes the whole chain.
+func openLayerBlob(blobPath string, mediaType string) (io.ReadCloser, error) {
+	f, err := os.Open(blobPath)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case gzipLayerMediaTypes[mediaType]:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: gz, closeFn: func() error {
+			gz.Close()
+			return f.Close()
+		}}, nil
+	case zstdLayerMediaTypes[mediaType]:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: zr.IOReadCloser(), closeFn: func() error {
+			zr.Close()
+			return f.Close()
+		}}, nil
+	default:
+		return f, nil
 	}
-	for _, layer := range manifest.Layers {
-		switch layer.MediaType {
-		case images.MediaTypeDockerSchema2LayerGzip:
-			err = UnTar(getLayerFilePath(imageDir, layer.Digest), containerWorkDir(workdir))
+}
+
+// readCloser adapts an io.Reader plus an explicit close function into an
+// io.ReadCloser, used to chain a decompressor's Close with the underlying
+// file's Close.
+type readCloser struct {
+	io.Reader
+	closeFn func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.closeFn()
+}
+
+const (
+	whiteoutPrefix       = ".wh."
+	whiteoutOpaqueMarker = ".wh..wh..opq"
+)
+
+// extractTar unpacks a plain (already decompressed) tar stream into dest,
+// preserving file modes, symlinks and hardlinks. Every entry's target path
+// (and, for a hardlink, its link destination) is required to stay inside
+// dest, rejecting the "tar-slip" trick of a name/linkname laden with ".."
+// or an absolute path that would otherwise write outside the image store.
+func extractTar(r io.Reader, dest string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target, err := safeJoin(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
 			if err != nil {
-				span.Logger().Error("用tar包解压层错误")
-				span.SetStatus(err)
 				return err
 			}
-		default:
-			err := fmt.Errorf("unsupport image %s layer %s media type:%s", image, layer.Digest.Encoded(), layer.MediaType)
-			span.SetStatus(err)
-			return err
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		case tar.TypeSymlink:
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linkTarget, err := safeJoin(dest, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(linkTarget, target); err != nil {
+				return err
+			}
 		}
 	}
+}
 
-	return nil
+// safeJoin joins dest and name the way extractTar and linkTree place tar
+// entries, then rejects the result if it doesn't stay inside dest - the
+// "tar-slip" guard against a name/linkname like "../../../etc/cron.d/x".
+func safeJoin(dest, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	if target != dest && !strings.HasPrefix(target, dest+string(os.PathSeparator)) {
+		return "", fmt.Errorf("tar entry %q escapes extraction root %q", name, dest)
+	}
+	return target, nil
 }
 
-func getLayerFilePath(imageDir string, digest digest.Digest) string {
-	return filepath.Join(imageDir, digest.Encoded())
+// linkTree composes a single extracted layer onto dst by hard-linking its
+// regular files into the same relative path, so materializing a pod's
+// rootfs never copies (or re-unzips) bytes owned by the shared layer store.
+// It also applies OCI image-layer whiteouts found in src: a ".wh.<name>"
+// entry removes <name> from dst instead of being linked itself, and a
+// ".wh..wh..opq" entry clears everything already materialized in its
+// directory (an "opaque whiteout").
+func linkTree(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == src {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == ".extracted" {
+			return nil
+		}
+
+		base := filepath.Base(rel)
+		relDir := filepath.Dir(rel)
+
+		if base == whiteoutOpaqueMarker {
+			target := filepath.Join(dst, relDir)
+			entries, err := ioutil.ReadDir(target)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			for _, e := range entries {
+				if err := os.RemoveAll(filepath.Join(target, e.Name())); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			removed := filepath.Join(dst, relDir, strings.TrimPrefix(base, whiteoutPrefix))
+			return os.RemoveAll(removed)
+		}
+
+		target, err := safeJoin(dst, rel)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		//上层layer必须覆盖下层已经materialize的同名文件,因此先移除已存在的
+		//target再link,而不是在os.IsExist时静默保留下层内容
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Link(path, target)
+	})
 }
 
 func containerWorkDir(workdir string) string {
 	return filepath.Join(workdir, "container")
 }
 
-func manifestDir(workdir string) string {
-	return filepath.Join(workdir, manifestFileName)
+// ResolveDigest re-resolves the manifest digest imageName currently points
+// to upstream, without downloading any layers (a HEAD-equivalent), so the
+// auto-update controller can detect a moved tag before deciding to pull.
+func (m *ImageManager) ResolveDigest(ctx context.Context, imageName string, opts PullImageOpts) (digest.Digest, error) {
+	ctx, span := trace.StartSpan(ctx, "ImageManager.ResolveDigest")
+	defer span.End()
+
+	srcRef, err := alltransports.ParseImageName(imageName)
+	if err != nil {
+		span.SetStatus(err)
+		return "", err
+	}
+	sourceCtx := &types.SystemContext{
+		DockerAuthConfig:            opts.DockerAuthConfig,
+		DockerBearerRegistryToken:   opts.DockerBearerRegistryToken,
+		DockerRegistryUserAgent:     opts.DockerRegistryUserAgent,
+		DockerInsecureSkipTLSVerify: opts.DockerInsecureSkipTLSVerify,
+		RegistriesDirPath:           opts.RegistriesDirPath,
+	}
+	d, err := m.resolveManifestDigest(ctx, srcRef, sourceCtx)
+	if err != nil {
+		span.SetStatus(err)
+		return "", err
+	}
+	return d, nil
+}
+
+// CurrentDigest returns the manifest digest imageName was last pulled to.
+func (m *ImageManager) CurrentDigest(imageName string) (digest.Digest, error) {
+	return m.getRef(imageName)
 }
 
-func getImageWorkDir(workdir string) string {
-	return filepath.Join(workdir, "image")
+// SetRef forcibly points imageName at manifestDigest without pulling
+// anything. It exists for the auto-update controller to roll an image
+// reference back to its previously known-good digest when a restarted
+// container fails its readiness window.
+func (m *ImageManager) SetRef(imageName string, manifestDigest digest.Digest) error {
+	return m.putRef(imageName, manifestDigest)
 }
 
-/*
-path=/path
-imageName=docker://imagename
+// VerifyImagePolicy resolves image against the registry (without
+// downloading any layers) and checks it against the configured trust
+// policy, so a pod requiring signature verification can be rejected by
+// Provider.verifyPullPolicy before CreatePod ever calls PullImage. opts
+// carries the same registry auth / insecure-TLS resolution PullImage uses,
+// so a private or insecure registry gets a real trust-policy verdict
+// instead of failing on registry auth.
+func (m *ImageManager) VerifyImagePolicy(ctx context.Context, imageName string, opts PullImageOpts) error {
+	ctx, span := trace.StartSpan(ctx, "ImageManager.VerifyImagePolicy")
+	defer span.End()
 
-docker-archive:/path/imagename.tar.gz
-/path/imagename.tar.gz
-*/
-func imageDestDir(path string, imageName string) (string, string, error) {
-	names := append(transports.ListNames(), "//")
-	replaceNames := make([]string, len(names)*2)
-	for i, n := range names {
-		replaceNames[i*2] = n
-		replaceNames[i*2+1] = ""
+	srcRef, err := alltransports.ParseImageName(imageName)
+	if err != nil {
+		span.SetStatus(err)
+		return err
 	}
-	replacer := strings.NewReplacer(replaceNames...)
-	replace := replacer.Replace(imageName)
-	imageName = replace
-	s, err := filenamify.Filenamify(imageName, filenamify.Options{Replacement: "-"})
+	policyContext, err := buildPolicyContext(m.trustPolicyPath, opts.SignaturePolicyPath)
 	if err != nil {
-		return "", "", err
+		span.SetStatus(err)
+		return err
 	}
-	filep := fmt.Sprintf("%s.tar.gz", filepath.Join(path, s))
-	return fmt.Sprintf("%s:%s", archive.Transport.Name(), filep), filep, nil
+	defer policyContext.Destroy()
+
+	sourceCtx := &types.SystemContext{
+		DockerAuthConfig:            opts.DockerAuthConfig,
+		DockerBearerRegistryToken:   opts.DockerBearerRegistryToken,
+		DockerRegistryUserAgent:     opts.DockerRegistryUserAgent,
+		DockerInsecureSkipTLSVerify: opts.DockerInsecureSkipTLSVerify,
+		RegistriesDirPath:           opts.RegistriesDirPath,
+	}
+	src, err := srcRef.NewImageSource(ctx, sourceCtx)
+	if err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	defer src.Close()
+
+	allowed, err := policyContext.IsRunningImageAllowed(ctx, image.UnparsedInstance(src, nil))
+	if err != nil {
+		span.SetStatus(err)
+		return err
+	}
+	if !allowed {
+		err := fmt.Errorf("image %s 未通过trust policy校验", imageName)
+		span.SetStatus(err)
+		return err
+	}
+	return nil
 }
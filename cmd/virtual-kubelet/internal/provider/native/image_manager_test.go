@@ -0,0 +1,180 @@
+package native
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("MkdirAll(%q): %v", path, err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("WriteFile(%q): %v", path, err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(%q): %v", path, err)
+	}
+	return string(data)
+}
+
+func TestSafeJoinRejectsEscapes(t *testing.T) {
+	cases := []struct {
+		name    string
+		entry   string
+		wantErr bool
+	}{
+		{"plain relative path", "foo/bar", false},
+		{"dotdot escape", "../../../etc/cron.d/x", true},
+		{"absolute path stays under dest", "/etc/cron.d/x", false}, // filepath.Join(dest, "/etc/...") stays under dest
+		{"dotdot that stays inside dest", "foo/../bar", false},
+		{"dotdot that exactly reaches dest", "foo/..", false},
+	}
+	dest := "/store/layer"
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			target, err := safeJoin(dest, c.entry)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("safeJoin(%q, %q) = %q, want error", dest, c.entry, target)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("safeJoin(%q, %q) unexpected error: %v", dest, c.entry, err)
+			}
+			if target != dest && target[:len(dest)+1] != dest+string(os.PathSeparator) {
+				t.Fatalf("safeJoin(%q, %q) = %q escapes dest", dest, c.entry, target)
+			}
+		})
+	}
+}
+
+func TestExtractTarRejectsTarSlip(t *testing.T) {
+	dest := t.TempDir()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{
+		Name:     "../../../etc/cron.d/evil",
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len("evil")),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	if _, err := tw.Write([]byte("evil")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	tw.Close()
+
+	if err := extractTar(&buf, dest); err == nil {
+		t.Fatalf("extractTar accepted a tar-slip entry")
+	}
+}
+
+func TestExtractTarRejectsHardlinkSlip(t *testing.T) {
+	dest := t.TempDir()
+	outside := t.TempDir()
+	writeFile(t, filepath.Join(outside, "secret"), "secret")
+
+	rel, err := filepath.Rel(dest, filepath.Join(outside, "secret"))
+	if err != nil {
+		t.Fatalf("Rel: %v", err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{
+		Name:     "link",
+		Typeflag: tar.TypeLink,
+		Linkname: rel,
+		Mode:     0644,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("WriteHeader: %v", err)
+	}
+	tw.Close()
+
+	if err := extractTar(&buf, dest); err == nil {
+		t.Fatalf("extractTar accepted a hardlink escaping dest")
+	}
+}
+
+func TestLinkTreeUpperLayerOverwritesLower(t *testing.T) {
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(dst, "app.conf"), "lower")
+
+	lower := t.TempDir()
+	writeFile(t, filepath.Join(lower, "app.conf"), "lower")
+	if err := linkTree(lower, dst); err != nil {
+		t.Fatalf("linkTree(lower): %v", err)
+	}
+
+	upper := t.TempDir()
+	writeFile(t, filepath.Join(upper, "app.conf"), "upper")
+	if err := linkTree(upper, dst); err != nil {
+		t.Fatalf("linkTree(upper): %v", err)
+	}
+
+	if got := readFile(t, filepath.Join(dst, "app.conf")); got != "upper" {
+		t.Fatalf("app.conf = %q, want the upper layer's content %q", got, "upper")
+	}
+}
+
+func TestLinkTreeWhiteoutRemovesLowerFile(t *testing.T) {
+	dst := t.TempDir()
+	lower := t.TempDir()
+	writeFile(t, filepath.Join(lower, "keep.txt"), "keep")
+	writeFile(t, filepath.Join(lower, "gone.txt"), "gone")
+	if err := linkTree(lower, dst); err != nil {
+		t.Fatalf("linkTree(lower): %v", err)
+	}
+
+	upper := t.TempDir()
+	writeFile(t, filepath.Join(upper, whiteoutPrefix+"gone.txt"), "")
+	if err := linkTree(upper, dst); err != nil {
+		t.Fatalf("linkTree(upper): %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dst, "gone.txt")); !os.IsNotExist(err) {
+		t.Fatalf("gone.txt should have been removed by the whiteout, stat err = %v", err)
+	}
+	if got := readFile(t, filepath.Join(dst, "keep.txt")); got != "keep" {
+		t.Fatalf("keep.txt = %q, want %q", got, "keep")
+	}
+}
+
+func TestLinkTreeOpaqueWhiteoutClearsDirectory(t *testing.T) {
+	dst := t.TempDir()
+	lower := t.TempDir()
+	writeFile(t, filepath.Join(lower, "dir", "a.txt"), "a")
+	writeFile(t, filepath.Join(lower, "dir", "b.txt"), "b")
+	if err := linkTree(lower, dst); err != nil {
+		t.Fatalf("linkTree(lower): %v", err)
+	}
+
+	upper := t.TempDir()
+	writeFile(t, filepath.Join(upper, "dir", whiteoutOpaqueMarker), "")
+	if err := linkTree(upper, dst); err != nil {
+		t.Fatalf("linkTree(upper): %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dst, "dir"))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("dir should be emptied by the opaque whiteout, got %v", entries)
+	}
+}
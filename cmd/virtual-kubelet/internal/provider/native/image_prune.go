@@ -0,0 +1,266 @@
+package native
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kok-stack/native-kubelet/trace"
+	"github.com/opencontainers/go-digest"
+)
+
+// PruneOptions mirrors the filters podman image prune exposes: Until/
+// Dangling/Filter narrow down which images are eligible, KeepBytes then
+// stops eviction once the store's on-disk size is at or below it, evicting
+// the least-recently-used eligible images first.
+type PruneOptions struct {
+	// Until only considers images whose last materialize was more than
+	// this long ago. Zero disables the age filter.
+	Until time.Duration
+	// Dangling restricts eligibility to images with no image reference
+	// currently pointing at them.
+	Dangling bool
+	// Filter matches against image references; only "reference" is
+	// currently supported (substring match).
+	Filter map[string]string
+	// KeepBytes, if non-zero, stops evicting once the on-disk size of the
+	// remaining images is at or below this threshold.
+	KeepBytes int64
+}
+
+// PruneResult reports what Prune actually removed.
+type PruneResult struct {
+	RemovedManifests []digest.Digest
+	ReclaimedBytes   int64
+}
+
+type manifestCandidate struct {
+	digest digest.Digest
+	entry  *ImageIndexEntry
+	refs   []string
+	size   int64
+}
+
+// Prune removes pulled images that match opts and are not referenced by
+// inUse (image references belonging to currently known pods), freeing their
+// blobs and extracted layer directories once no remaining manifest needs
+// them.
+func (m *ImageManager) Prune(ctx context.Context, opts PruneOptions, inUse map[string]bool) (*PruneResult, error) {
+	ctx, span := trace.StartSpan(ctx, "ImageManager.Prune")
+	defer span.End()
+
+	//Dangling/Until/Filter都未设置时,候选集合就是"所有未被引用的镜像";此时如果
+	//KeepBytes也<=0(未配置容量上限),说明调用方根本没有表达任何清理意图,必须
+	//是no-op,而不是把整个共享store清空
+	if opts.KeepBytes <= 0 && !opts.Dangling && opts.Until <= 0 && len(opts.Filter) == 0 {
+		return &PruneResult{}, nil
+	}
+
+	refsByManifest, err := m.refsByManifest()
+	if err != nil {
+		span.SetStatus(err)
+		return nil, err
+	}
+	//没有任何ref指向的manifest(dangling)不会出现在refsByManifest里,在此补上
+	for key := range m.imageDb.Keys() {
+		k := string(key)
+		if !strings.HasPrefix(k, manifestKeyPrefix) {
+			continue
+		}
+		d, err := digest.Parse(strings.TrimPrefix(k, manifestKeyPrefix))
+		if err != nil {
+			continue
+		}
+		if _, ok := refsByManifest[d]; !ok {
+			refsByManifest[d] = nil
+		}
+	}
+
+	candidates := make([]manifestCandidate, 0)
+	for d, refs := range refsByManifest {
+		if referencesInUse(refs, inUse) {
+			continue
+		}
+		if m.isPinned(d) {
+			//该digest正被pull或处于auto-update的回滚窗口内,此时它的ref/blob可能
+			//随时被重新指向或需要恢复,不能当成candidate清理掉
+			continue
+		}
+		entry, err := m.getManifestEntry(d)
+		if err != nil {
+			continue
+		}
+		if opts.Dangling && len(refs) > 0 {
+			continue
+		}
+		if opts.Until > 0 && time.Since(entry.LastUsed) < opts.Until {
+			continue
+		}
+		if !matchesFilter(opts.Filter, refs) {
+			continue
+		}
+		candidates = append(candidates, manifestCandidate{digest: d, entry: entry, refs: refs, size: m.manifestSize(entry)})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].entry.LastUsed.Before(candidates[j].entry.LastUsed)
+	})
+
+	result := &PruneResult{}
+	remaining := m.totalSize()
+	for _, c := range candidates {
+		if opts.KeepBytes > 0 && remaining <= opts.KeepBytes {
+			break
+		}
+		freed, err := m.removeManifest(ctx, c.digest, c.refs)
+		if err != nil {
+			span.SetStatus(err)
+			return result, err
+		}
+		remaining -= freed
+		result.RemovedManifests = append(result.RemovedManifests, c.digest)
+		result.ReclaimedBytes += freed
+	}
+	return result, nil
+}
+
+func referencesInUse(refs []string, inUse map[string]bool) bool {
+	for _, r := range refs {
+		if inUse[r] {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesFilter(filter map[string]string, refs []string) bool {
+	reference, ok := filter["reference"]
+	if !ok || reference == "" {
+		return true
+	}
+	for _, r := range refs {
+		if strings.Contains(r, reference) {
+			return true
+		}
+	}
+	return false
+}
+
+// refsByManifest walks the bitcask "ref:" keys and groups the image
+// references that currently resolve to each manifest digest.
+func (m *ImageManager) refsByManifest() (map[digest.Digest][]string, error) {
+	result := map[digest.Digest][]string{}
+	for key := range m.imageDb.Keys() {
+		k := string(key)
+		if !strings.HasPrefix(k, refKeyPrefix) {
+			continue
+		}
+		imageName := strings.TrimPrefix(k, refKeyPrefix)
+		d, err := m.getRef(imageName)
+		if err != nil {
+			continue
+		}
+		result[d] = append(result[d], imageName)
+	}
+	return result, nil
+}
+
+func (m *ImageManager) manifestSize(entry *ImageIndexEntry) int64 {
+	var total int64
+	if fi, err := os.Stat(m.blobPath(entry.ManifestDigest)); err == nil {
+		total += fi.Size()
+	}
+	for _, l := range entry.Layers {
+		if fi, err := os.Stat(m.blobPath(l)); err == nil {
+			total += fi.Size()
+		}
+	}
+	return total
+}
+
+func (m *ImageManager) totalSize() int64 {
+	var total int64
+	_ = filepath.Walk(m.blobsDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || info.IsDir() {
+			return nil
+		}
+		total += info.Size()
+		return nil
+	})
+	return total
+}
+
+// removeManifest deletes every ref pointing at d, the manifest entry
+// itself, and any layer blob/extracted directory no longer referenced by a
+// remaining manifest, returning the number of bytes reclaimed.
+func (m *ImageManager) removeManifest(ctx context.Context, d digest.Digest, refs []string) (int64, error) {
+	_, span := trace.StartSpan(ctx, "ImageManager.removeManifest")
+	defer span.End()
+
+	entry, err := m.getManifestEntry(d)
+	if err != nil {
+		span.SetStatus(err)
+		return 0, err
+	}
+
+	var freed int64
+	for _, ref := range refs {
+		if err := m.imageDb.Delete([]byte(refKeyPrefix + ref)); err != nil {
+			span.SetStatus(err)
+			return freed, err
+		}
+	}
+	if err := m.imageDb.Delete([]byte(manifestKeyPrefix + d.String())); err != nil {
+		span.SetStatus(err)
+		return freed, err
+	}
+
+	stillNeeded, err := m.layersStillNeeded(d)
+	if err != nil {
+		span.SetStatus(err)
+		return freed, err
+	}
+	for _, l := range entry.Layers {
+		if stillNeeded[l] {
+			continue
+		}
+		if fi, err := os.Stat(m.blobPath(l)); err == nil {
+			freed += fi.Size()
+		}
+		os.Remove(m.blobPath(l))
+		os.RemoveAll(filepath.Join(m.layersDir(), l.Encoded()))
+	}
+	if fi, err := os.Stat(m.blobPath(d)); err == nil {
+		freed += fi.Size()
+	}
+	os.Remove(m.blobPath(d))
+	return freed, nil
+}
+
+// layersStillNeeded returns the set of layer digests referenced by any
+// manifest entry other than exclude, so removeManifest only frees blobs
+// that have become truly unreachable.
+func (m *ImageManager) layersStillNeeded(exclude digest.Digest) (map[digest.Digest]bool, error) {
+	needed := map[digest.Digest]bool{}
+	for key := range m.imageDb.Keys() {
+		k := string(key)
+		if !strings.HasPrefix(k, manifestKeyPrefix) {
+			continue
+		}
+		d, err := digest.Parse(strings.TrimPrefix(k, manifestKeyPrefix))
+		if err != nil || d == exclude {
+			continue
+		}
+		entry, err := m.getManifestEntry(d)
+		if err != nil {
+			continue
+		}
+		for _, l := range entry.Layers {
+			needed[l] = true
+		}
+	}
+	return needed, nil
+}
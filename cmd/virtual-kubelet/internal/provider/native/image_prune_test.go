@@ -0,0 +1,151 @@
+package native
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/prologic/bitcask"
+)
+
+// newTestImageManager builds an ImageManager backed by a real bitcask store
+// under t.TempDir(), the same way Provider.start wires one up.
+func newTestImageManager(t *testing.T) *ImageManager {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := bitcask.Open(filepath.Join(dir, "db"))
+	if err != nil {
+		t.Fatalf("bitcask.Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return NewImageManager(filepath.Join(dir, "images"), db, 0, "")
+}
+
+// seedManifest registers imageName -> a manifest with the given layer sizes
+// and lastUsed time, writing real blob files so totalSize/manifestSize see
+// non-zero sizes.
+func seedManifest(t *testing.T, m *ImageManager, imageName string, lastUsed time.Time, layerSizes ...int) digest.Digest {
+	t.Helper()
+	d := digest.FromString(imageName)
+	layers := make([]digest.Digest, 0, len(layerSizes))
+	if err := os.MkdirAll(m.blobsDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	for i, size := range layerSizes {
+		l := digest.FromString(imageName + string(rune('a'+i)))
+		layers = append(layers, l)
+		if err := os.WriteFile(m.blobPath(l), make([]byte, size), 0644); err != nil {
+			t.Fatalf("WriteFile layer: %v", err)
+		}
+	}
+	if err := os.WriteFile(m.blobPath(d), []byte("manifest"), 0644); err != nil {
+		t.Fatalf("WriteFile manifest: %v", err)
+	}
+	if err := m.putManifestEntry(d, &ImageIndexEntry{ManifestDigest: d, Layers: layers, LastUsed: lastUsed}); err != nil {
+		t.Fatalf("putManifestEntry: %v", err)
+	}
+	if err := m.putRef(imageName, d); err != nil {
+		t.Fatalf("putRef: %v", err)
+	}
+	return d
+}
+
+func TestPruneZeroKeepBytesIsNoop(t *testing.T) {
+	m := newTestImageManager(t)
+	seedManifest(t, m, "example.com/a:latest", time.Now().Add(-time.Hour), 100)
+
+	result, err := m.Prune(context.Background(), PruneOptions{}, map[string]bool{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if len(result.RemovedManifests) != 0 {
+		t.Fatalf("Prune with zero-value PruneOptions removed %v, want a no-op", result.RemovedManifests)
+	}
+}
+
+func TestPruneDanglingExplicitlyRemovesRegardlessOfKeepBytes(t *testing.T) {
+	m := newTestImageManager(t)
+	d := seedManifest(t, m, "example.com/dangling:latest", time.Now().Add(-time.Hour), 100)
+	// Delete the ref so the manifest has no surviving reference, i.e. is dangling.
+	if err := m.imageDb.Delete([]byte(refKeyPrefix + "example.com/dangling:latest")); err != nil {
+		t.Fatalf("Delete ref: %v", err)
+	}
+
+	result, err := m.Prune(context.Background(), PruneOptions{Dangling: true}, map[string]bool{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if len(result.RemovedManifests) != 1 || result.RemovedManifests[0] != d {
+		t.Fatalf("Prune(Dangling: true) = %v, want [%v]", result.RemovedManifests, d)
+	}
+}
+
+func TestPruneSkipsInUseImages(t *testing.T) {
+	m := newTestImageManager(t)
+	seedManifest(t, m, "example.com/used:latest", time.Now().Add(-time.Hour), 100)
+
+	result, err := m.Prune(context.Background(), PruneOptions{Until: time.Minute}, map[string]bool{"example.com/used:latest": true})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if len(result.RemovedManifests) != 0 {
+		t.Fatalf("Prune removed an in-use image: %v", result.RemovedManifests)
+	}
+}
+
+func TestPruneEvictsLeastRecentlyUsedFirstUntilKeepBytes(t *testing.T) {
+	m := newTestImageManager(t)
+	oldest := seedManifest(t, m, "example.com/oldest:latest", time.Now().Add(-3*time.Hour), 100)
+	seedManifest(t, m, "example.com/middle:latest", time.Now().Add(-2*time.Hour), 100)
+	seedManifest(t, m, "example.com/newest:latest", time.Now().Add(-1*time.Hour), 100)
+
+	// 3 manifests * (100 bytes layer + len("manifest") bytes) on disk; ask to
+	// keep enough for only the two most recently used.
+	keepBytes := m.totalSize() - 1
+	result, err := m.Prune(context.Background(), PruneOptions{KeepBytes: keepBytes}, map[string]bool{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if len(result.RemovedManifests) != 1 || result.RemovedManifests[0] != oldest {
+		t.Fatalf("Prune(KeepBytes) removed %v, want only the oldest manifest [%v]", result.RemovedManifests, oldest)
+	}
+}
+
+func TestPruneSkipsPinnedDigests(t *testing.T) {
+	m := newTestImageManager(t)
+	d := seedManifest(t, m, "example.com/pinned:latest", time.Now().Add(-time.Hour), 100)
+	m.pinDigest(d)
+	defer m.unpinDigest(d)
+
+	result, err := m.Prune(context.Background(), PruneOptions{Until: time.Minute}, map[string]bool{})
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if len(result.RemovedManifests) != 0 {
+		t.Fatalf("Prune removed a pinned digest: %v", result.RemovedManifests)
+	}
+}
+
+func TestMatchesFilterByReference(t *testing.T) {
+	cases := []struct {
+		name   string
+		filter map[string]string
+		refs   []string
+		want   bool
+	}{
+		{"nil filter matches anything", nil, []string{"example.com/a:latest"}, true},
+		{"empty reference value matches anything", map[string]string{"reference": ""}, []string{"example.com/a:latest"}, true},
+		{"substring match", map[string]string{"reference": "a:latest"}, []string{"example.com/a:latest"}, true},
+		{"no match", map[string]string{"reference": "b:latest"}, []string{"example.com/a:latest"}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := matchesFilter(c.filter, c.refs); got != c.want {
+				t.Errorf("matchesFilter(%v, %v) = %v, want %v", c.filter, c.refs, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package native
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/kok-stack/native-kubelet/trace"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	statsapi "k8s.io/kubelet/pkg/apis/stats/v1alpha1"
+	"time"
+)
+
+// ContainerProcess is the per-container process handle processManager
+// tracks for every launched native process, exposed so stats collection can
+// read cpu/memory/io accounting straight out of the host without a
+// container runtime in between.
+type ContainerProcess struct {
+	Name      string
+	PID       int
+	StartedAt time.Time
+}
+
+// GetStatsSummary implements virtual-kubelet's PodMetricsProvider, sourcing
+// cpu/memory numbers directly from the host processes processManager
+// launched for each pod rather than from a container runtime, so
+// `kubectl top pod` and HPA work against this provider.
+func (p *Provider) GetStatsSummary(ctx context.Context) (*statsapi.Summary, error) {
+	ctx, span := trace.StartSpan(ctx, "Provider.GetStatsSummary")
+	defer span.End()
+
+	pods, err := p.downPodLister.List(labels.Everything())
+	if err != nil {
+		span.SetStatus(err)
+		return nil, err
+	}
+
+	now := metav1.Now()
+	summary := &statsapi.Summary{
+		Node: statsapi.NodeStats{
+			NodeName:  p.initConfig.NodeName,
+			StartTime: metav1.NewTime(p.startTime),
+		},
+	}
+	for _, pod := range pods {
+		podStat := p.podStats(pod, now)
+		summary.Pods = append(summary.Pods, *podStat)
+	}
+	return summary, nil
+}
+
+func (p *Provider) podStats(pod *v1.Pod, now metav1.Time) *statsapi.PodStats {
+	podStat := &statsapi.PodStats{
+		PodRef: statsapi.PodReference{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+			UID:       string(pod.UID),
+		},
+		StartTime: metav1.NewTime(pod.CreationTimestamp.Time),
+	}
+
+	var podCPUNanos, podRSSBytes, podPageFaults, podRxBytes, podTxBytes uint64
+	for _, c := range p.processManager.ListContainers(pod.Namespace, pod.Name) {
+		procStats, err := readProcessStats(c.PID)
+		if err != nil {
+			continue
+		}
+		cpuNanos := procStats.cpuNanos
+		rssBytes := procStats.rssBytes
+		pageFaults := procStats.pageFaults
+		podStat.Containers = append(podStat.Containers, statsapi.ContainerStats{
+			Name:      c.Name,
+			StartTime: metav1.NewTime(c.StartedAt),
+			CPU: &statsapi.CPUStats{
+				Time:                 now,
+				UsageCoreNanoSeconds: &cpuNanos,
+			},
+			Memory: &statsapi.MemoryStats{
+				Time:            now,
+				WorkingSetBytes: &rssBytes,
+				RSSBytes:        &rssBytes,
+				PageFaults:      &pageFaults,
+			},
+		})
+		podCPUNanos += cpuNanos
+		podRSSBytes += rssBytes
+		podPageFaults += pageFaults
+		podRxBytes += procStats.netRxBytes
+		podTxBytes += procStats.netTxBytes
+	}
+	podStat.CPU = &statsapi.CPUStats{Time: now, UsageCoreNanoSeconds: &podCPUNanos}
+	podStat.Memory = &statsapi.MemoryStats{Time: now, WorkingSetBytes: &podRSSBytes, PageFaults: &podPageFaults}
+	podStat.Network = &statsapi.NetworkStats{
+		Time: now,
+		InterfaceStats: statsapi.InterfaceStats{
+			Name:    "eth0",
+			RxBytes: &podRxBytes,
+			TxBytes: &podTxBytes,
+		},
+	}
+	return podStat
+}
+
+// GetMetricsResource returns the same per-container host accounting as
+// GetStatsSummary, shaped as Prometheus metric families so it can be served
+// straight from the virtual-kubelet /metrics/resource HTTP handler.
+func (p *Provider) GetMetricsResource(ctx context.Context) ([]*dto.MetricFamily, error) {
+	ctx, span := trace.StartSpan(ctx, "Provider.GetMetricsResource")
+	defer span.End()
+
+	pods, err := p.downPodLister.List(labels.Everything())
+	if err != nil {
+		span.SetStatus(err)
+		return nil, err
+	}
+
+	cpuFamily := &dto.MetricFamily{
+		Name: proto.String("container_cpu_usage_seconds_total"),
+		Help: proto.String("Cumulative cpu time consumed by the container in core-seconds"),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+	memFamily := &dto.MetricFamily{
+		Name: proto.String("container_memory_working_set_bytes"),
+		Help: proto.String("Current working set memory of the container in bytes"),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	pageFaultsFamily := &dto.MetricFamily{
+		Name: proto.String("container_memory_page_faults_total"),
+		Help: proto.String("Cumulative count of page faults incurred by the container"),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+	netRxFamily := &dto.MetricFamily{
+		Name: proto.String("container_network_receive_bytes_total"),
+		Help: proto.String("Cumulative bytes received by the container over the network"),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+	netTxFamily := &dto.MetricFamily{
+		Name: proto.String("container_network_transmit_bytes_total"),
+		Help: proto.String("Cumulative bytes transmitted by the container over the network"),
+		Type: dto.MetricType_COUNTER.Enum(),
+	}
+
+	for _, pod := range pods {
+		for _, c := range p.processManager.ListContainers(pod.Namespace, pod.Name) {
+			procStats, err := readProcessStats(c.PID)
+			if err != nil {
+				continue
+			}
+			labelPairs := []*dto.LabelPair{
+				{Name: proto.String("namespace"), Value: proto.String(pod.Namespace)},
+				{Name: proto.String("pod"), Value: proto.String(pod.Name)},
+				{Name: proto.String("container"), Value: proto.String(c.Name)},
+			}
+			cpuFamily.Metric = append(cpuFamily.Metric, &dto.Metric{
+				Label:   labelPairs,
+				Counter: &dto.Counter{Value: proto.Float64(float64(procStats.cpuNanos) / 1e9)},
+			})
+			memFamily.Metric = append(memFamily.Metric, &dto.Metric{
+				Label: labelPairs,
+				Gauge: &dto.Gauge{Value: proto.Float64(float64(procStats.rssBytes))},
+			})
+			pageFaultsFamily.Metric = append(pageFaultsFamily.Metric, &dto.Metric{
+				Label:   labelPairs,
+				Counter: &dto.Counter{Value: proto.Float64(float64(procStats.pageFaults))},
+			})
+			netRxFamily.Metric = append(netRxFamily.Metric, &dto.Metric{
+				Label:   labelPairs,
+				Counter: &dto.Counter{Value: proto.Float64(float64(procStats.netRxBytes))},
+			})
+			netTxFamily.Metric = append(netTxFamily.Metric, &dto.Metric{
+				Label:   labelPairs,
+				Counter: &dto.Counter{Value: proto.Float64(float64(procStats.netTxBytes))},
+			})
+		}
+	}
+	return []*dto.MetricFamily{cpuFamily, memFamily, pageFaultsFamily, netRxFamily, netTxFamily}, nil
+}
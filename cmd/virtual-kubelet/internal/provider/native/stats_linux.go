@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package native
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const clockTicksPerSecond = 100
+
+// processStats is the host-sourced accounting for a single container
+// process: /proc/<pid>/stat and /proc/<pid>/status first, then cgroup v2
+// memory.current/cpu.stat when the process was placed in its own cgroup
+// slice, since those numbers include children the single pid's /proc entry
+// does not.
+type processStats struct {
+	cpuNanos   uint64
+	rssBytes   uint64
+	pageFaults uint64
+	netRxBytes uint64
+	netTxBytes uint64
+}
+
+// readProcessStats aggregates cpu nanoseconds, RSS, page faults and network
+// counters for pid out of /proc and, when present, its cgroup v2 slice.
+func readProcessStats(pid int) (*processStats, error) {
+	stat := &processStats{}
+	if err := readProcStat(pid, stat); err != nil {
+		return nil, err
+	}
+	readProcStatus(pid, stat)
+	readProcNetDev(pid, stat)
+	readCgroupStats(pid, stat)
+	return stat, nil
+}
+
+func readProcStat(pid int, stat *processStats) error {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return err
+	}
+	// comm is wrapped in parentheses and may itself contain spaces/parens,
+	// so skip past the last ')' before splitting on whitespace.
+	end := strings.LastIndex(string(data), ")")
+	if end == -1 || end+2 >= len(data) {
+		return fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+	fields := strings.Fields(string(data)[end+2:])
+	if len(fields) < 13 {
+		return fmt.Errorf("unexpected /proc/%d/stat field count", pid)
+	}
+	majflt, _ := strconv.ParseUint(fields[9], 10, 64)
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	stat.pageFaults = majflt
+	stat.cpuNanos = (utime + stime) * uint64(time.Second) / clockTicksPerSecond
+	return nil
+}
+
+func readProcStatus(pid int, stat *processStats) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			if kb, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				stat.rssBytes = kb * 1024
+			}
+		}
+	}
+}
+
+// readProcNetDev sums rx/tx bytes across every non-loopback interface
+// visible in pid's netns.
+func readProcNetDev(pid int, stat *processStats) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		if lineNo <= 2 {
+			continue // header lines
+		}
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(parts) != 2 || parts[0] == "lo" {
+			continue
+		}
+		fields := strings.Fields(parts[1])
+		if len(fields) < 9 {
+			continue
+		}
+		rx, _ := strconv.ParseUint(fields[0], 10, 64)
+		tx, _ := strconv.ParseUint(fields[8], 10, 64)
+		stat.netRxBytes += rx
+		stat.netTxBytes += tx
+	}
+}
+
+// readCgroupStats overrides the /proc-derived memory and cpu numbers with
+// cgroup v2 memory.current/cpu.stat when pid has been placed in its own
+// slice, since those already aggregate every thread/child in the slice.
+func readCgroupStats(pid int, stat *processStats) {
+	cgroupPath, err := cgroupV2Path(pid)
+	if err != nil {
+		return
+	}
+	// A pid still in the provider's own cgroup has no slice of its own.
+	if self, err := cgroupV2Path(os.Getpid()); err == nil && self == cgroupPath {
+		return
+	}
+	base := filepath.Join("/sys/fs/cgroup", cgroupPath)
+	if data, err := os.ReadFile(filepath.Join(base, "memory.current")); err == nil {
+		if v, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil {
+			stat.rssBytes = v
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(base, "cpu.stat")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 2 && fields[0] == "usage_usec" {
+				if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+					stat.cpuNanos = v * 1000
+				}
+			}
+		}
+	}
+}
+
+func cgroupV2Path(pid int) (string, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) == 3 && parts[0] == "0" {
+			return parts[2], nil
+		}
+	}
+	return "", fmt.Errorf("cgroup v2 path not found for pid %d", pid)
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package native
+
+import (
+	"github.com/shirou/gopsutil/v3/process"
+	"time"
+)
+
+// processStats mirrors the linux-only variant but is populated via
+// gopsutil, since there is no /proc or cgroup v2 to read on macOS and other
+// hosts.
+type processStats struct {
+	cpuNanos   uint64
+	rssBytes   uint64
+	pageFaults uint64
+	netRxBytes uint64
+	netTxBytes uint64
+}
+
+// readProcessStats falls back to gopsutil for cpu/memory accounting on
+// platforms without /proc or cgroup v2.
+func readProcessStats(pid int) (*processStats, error) {
+	proc, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return nil, err
+	}
+	stat := &processStats{}
+	if times, err := proc.Times(); err == nil {
+		stat.cpuNanos = uint64((times.User + times.System) * float64(time.Second))
+	}
+	if mem, err := proc.MemoryInfo(); err == nil {
+		stat.rssBytes = mem.RSS
+	}
+	return stat, nil
+}